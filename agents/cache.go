@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TaskState is a stage in a cached task's lifecycle.
+type TaskState string
+
+const (
+	TaskStateReceived  TaskState = "received"
+	TaskStateExecuting TaskState = "executing"
+	TaskStateCompleted TaskState = "completed"
+	TaskStateFailed    TaskState = "failed"
+)
+
+// workloadCacheDir is where every received Task is cached before it's
+// executed, keyed by task ID, so an interrupted reboot/shutdown can be
+// reconciled with the server on next startup.
+const workloadCacheDir = "/var/lib/pxe-agent/workload"
+
+// CachedTask is a Task plus its lifecycle state as last persisted to disk.
+type CachedTask struct {
+	Task      Task      `json:"task"`
+	State     TaskState `json:"state"`
+	UpdatedAt int64     `json:"updated_at"`
+}
+
+func workloadCachePath(taskID int) string {
+	return filepath.Join(workloadCacheDir, fmt.Sprintf("%d.json", taskID))
+}
+
+// cacheTask persists task's current state to disk and publishes it to
+// pxe.tasks.<mac>.state.<id>, so the server can observe state transitions
+// even across an agent reboot that happens mid-task.
+func cacheTask(env *ProviderEnv, task *Task, state TaskState) {
+	cached := CachedTask{Task: *task, State: state, UpdatedAt: time.Now().Unix()}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		log.Printf("Failed to marshal cached task %d: %v", task.ID, err)
+		return
+	}
+
+	if err := os.MkdirAll(workloadCacheDir, 0755); err != nil {
+		log.Printf("Failed to create workload cache dir: %v", err)
+		return
+	}
+	if err := os.WriteFile(workloadCachePath(task.ID), data, 0644); err != nil {
+		log.Printf("Failed to write cached task %d: %v", task.ID, err)
+		return
+	}
+
+	subject := fmt.Sprintf("pxe.tasks.%s.state.%d", env.MacAddress, task.ID)
+	if err := env.NC.Publish(subject, data); err != nil {
+		log.Printf("Failed to publish state for task %d: %v", task.ID, err)
+	}
+}
+
+// clearCachedTask removes a task's on-disk cache entry once it's reached a
+// terminal state.
+func clearCachedTask(taskID int) {
+	if err := os.Remove(workloadCachePath(taskID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove cached task %d: %v", taskID, err)
+	}
+}
+
+// loadCachedTasks reads every task cache entry left on disk, e.g. by a
+// previous run that rebooted mid-task.
+func loadCachedTasks() []CachedTask {
+	entries, err := os.ReadDir(workloadCacheDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read workload cache dir: %v", err)
+		}
+		return nil
+	}
+
+	var cached []CachedTask
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(workloadCacheDir, entry.Name()))
+		if err != nil {
+			log.Printf("Failed to read cached task %s: %v", entry.Name(), err)
+			continue
+		}
+		var ct CachedTask
+		if err := json.Unmarshal(data, &ct); err != nil {
+			log.Printf("Failed to parse cached task %s: %v", entry.Name(), err)
+			continue
+		}
+		cached = append(cached, ct)
+	}
+	return cached
+}
+
+// restartsHost reports whether taskType's provider reboots or powers off
+// the host as part of executing it. A cache entry for one of these left in
+// "executing" means the restart itself already happened - this process
+// coming back up and reading the cache IS the proof - so replaying it must
+// not call Execute again, or the host would just restart in a loop.
+func restartsHost(taskType string) bool {
+	return taskType == "reboot" || taskType == "shutdown"
+}
+
+// replayCachedTasks reconciles every task left in a non-terminal state by a
+// previous run. A reboot/shutdown task found here already ran to the point
+// of restarting the host, so it's reconciled as completed instead of being
+// re-executed; any other task type is re-run through the normal provider
+// dispatch. Either way its cache entry is cleared afterward.
+func replayCachedTasks(ctx context.Context, providers map[string]TaskProvider, env *ProviderEnv) {
+	for _, ct := range loadCachedTasks() {
+		if ct.State == TaskStateCompleted || ct.State == TaskStateFailed {
+			clearCachedTask(ct.Task.ID)
+			continue
+		}
+
+		task := ct.Task
+
+		if restartsHost(task.Type) {
+			log.Printf("Reconciling task %d (%s) as completed: agent restart is evidence it ran", task.ID, task.Type)
+			reportTaskCompletion(env, task.ID, true, fmt.Sprintf("%s completed (reconciled after agent restart)", task.Type))
+			cacheTask(env, &task, TaskStateCompleted)
+			clearCachedTask(task.ID)
+			continue
+		}
+
+		log.Printf("Replaying task %d (was %q when agent last stopped)", task.ID, ct.State)
+		cacheTask(env, &task, TaskStateExecuting)
+		if executeTask(ctx, providers, env, &task) {
+			cacheTask(env, &task, TaskStateCompleted)
+		} else {
+			cacheTask(env, &task, TaskStateFailed)
+		}
+		clearCachedTask(task.ID)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Inventory is the hardware/OS snapshot this agent publishes to
+// pxe.inventory.<mac> every -heartbeat interval, so the PXE server has a
+// real-time view of provisioned hosts without having to poll them.
+type Inventory struct {
+	MacAddress    string                 `json:"mac_address"`
+	CPUModel      string                 `json:"cpu_model"`
+	CPUCount      int                    `json:"cpu_count"`
+	MemoryTotalKB int64                  `json:"memory_total_kb"`
+	Disks         []string               `json:"disks"`
+	NICs          map[string]string      `json:"nics"`
+	Kernel        string                 `json:"kernel"`
+	UptimeSeconds float64                `json:"uptime_seconds"`
+	KernelCmdline string                 `json:"kernel_cmdline"`
+	LLDPNeighbor  string                 `json:"lldp_neighbor,omitempty"`
+	Facts         map[string]interface{} `json:"facts,omitempty"`
+	CollectedAt   int64                  `json:"collected_at"`
+}
+
+// runHeartbeat publishes a liveness ping to pxe.heartbeat.<mac> and a full
+// Inventory to pxe.inventory.<mac> immediately, then again every interval,
+// until the process exits.
+func runHeartbeat(nc *nats.Conn, macAddress, factsScript string, interval time.Duration) {
+	publishHeartbeat(nc, macAddress, factsScript)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		publishHeartbeat(nc, macAddress, factsScript)
+	}
+}
+
+func publishHeartbeat(nc *nats.Conn, macAddress, factsScript string) {
+	if err := nc.Publish(fmt.Sprintf("pxe.heartbeat.%s", macAddress), []byte(strconv.FormatInt(time.Now().Unix(), 10))); err != nil {
+		log.Printf("Failed to publish heartbeat: %v", err)
+	}
+
+	inv := gatherInventory(macAddress, factsScript)
+	data, err := json.Marshal(inv)
+	if err != nil {
+		log.Printf("Failed to marshal inventory: %v", err)
+		return
+	}
+	if err := nc.Publish(fmt.Sprintf("pxe.inventory.%s", macAddress), data); err != nil {
+		log.Printf("Failed to publish inventory: %v", err)
+	}
+}
+
+func gatherInventory(macAddress, factsScript string) Inventory {
+	cpuModel, cpuCount := readCPUInfo()
+
+	return Inventory{
+		MacAddress:    macAddress,
+		CPUModel:      cpuModel,
+		CPUCount:      cpuCount,
+		MemoryTotalKB: readMemTotalKB(),
+		Disks:         readDisks(),
+		NICs:          readNICs(),
+		Kernel:        readKernelRelease(),
+		UptimeSeconds: readUptimeSeconds(),
+		KernelCmdline: readKernelCmdline(),
+		LLDPNeighbor:  readLLDPNeighbor(),
+		Facts:         runFactsScript(factsScript),
+		CollectedAt:   time.Now().Unix(),
+	}
+}
+
+// readCPUInfo returns the model name reported for the first processor and
+// the total number of logical processors in /proc/cpuinfo.
+func readCPUInfo() (model string, count int) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		log.Printf("Failed to read /proc/cpuinfo: %v", err)
+		return "", 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "processor"):
+			count++
+		case model == "" && strings.HasPrefix(line, "model name"):
+			if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+				model = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	return model, count
+}
+
+// readMemTotalKB returns MemTotal from /proc/meminfo, in kilobytes.
+func readMemTotalKB() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		log.Printf("Failed to read /proc/meminfo: %v", err)
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb
+		}
+	}
+	return 0
+}
+
+// readDisks returns the block device names under /sys/block, excluding
+// virtual devices (loop, ram) that aren't real disks.
+func readDisks() []string {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		log.Printf("Failed to read /sys/block: %v", err)
+		return nil
+	}
+
+	var disks []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		disks = append(disks, name)
+	}
+	return disks
+}
+
+// readNICs maps interface name to MAC address for every interface under
+// /sys/class/net, excluding loopback.
+func readNICs() map[string]string {
+	entries, err := os.ReadDir("/sys/class/net")
+	if err != nil {
+		log.Printf("Failed to read /sys/class/net: %v", err)
+		return nil
+	}
+
+	nics := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "lo" {
+			continue
+		}
+		addr, err := os.ReadFile(filepath.Join("/sys/class/net", name, "address"))
+		if err != nil {
+			continue
+		}
+		nics[name] = strings.TrimSpace(string(addr))
+	}
+	return nics
+}
+
+// readKernelRelease returns the running kernel version, e.g. "6.8.0-generic".
+func readKernelRelease() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		log.Printf("Failed to read /proc/sys/kernel/osrelease: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readUptimeSeconds returns the first field of /proc/uptime.
+func readUptimeSeconds() float64 {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		log.Printf("Failed to read /proc/uptime: %v", err)
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return uptime
+}
+
+// readKernelCmdline returns the running kernel's boot command line.
+func readKernelCmdline() string {
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		log.Printf("Failed to read /proc/cmdline: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readLLDPNeighbor returns the raw JSON output of `lldpctl -f json`, or ""
+// if lldpctl isn't installed or fails. The output is not parsed, so it can
+// describe several neighbors or none. Absence of lldpctl is expected on
+// most hosts, so it's not treated as an error.
+func readLLDPNeighbor() string {
+	out, err := exec.Command("lldpctl", "-f", "json").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// runFactsScript runs the optional -facts-script and parses its stdout as
+// a JSON object, merged into the inventory payload under "facts". A
+// missing or failing script is logged but not fatal to the heartbeat.
+func runFactsScript(path string) map[string]interface{} {
+	if path == "" {
+		return nil
+	}
+
+	out, err := exec.Command(path).Output()
+	if err != nil {
+		log.Printf("Facts script %s failed: %v", path, err)
+		return nil
+	}
+
+	var facts map[string]interface{}
+	if err := json.Unmarshal(out, &facts); err != nil {
+		log.Printf("Facts script %s did not produce a JSON object: %v", path, err)
+		return nil
+	}
+	return facts
+}
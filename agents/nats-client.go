@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,11 +11,14 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 // Task represents a task from the PXE server
@@ -22,16 +28,115 @@ type Task struct {
 	Command string `json:"command"`
 }
 
+// Envelope is the signed wrapper the PXE server publishes to pxe.tasks.<mac>.
+// Agents verify the signature against -server-nkey before acting on Task.
+type Envelope struct {
+	Task      Task   `json:"task"`
+	Signature string `json:"signature"`
+	Nonce     string `json:"nonce"`
+	IssuedAt  int64  `json:"issued_at"`
+}
+
+// signedPayload returns the exact bytes the server is expected to have
+// signed: the task plus the anti-replay fields, excluding the signature.
+func (e *Envelope) signedPayload() ([]byte, error) {
+	return json.Marshal(struct {
+		Task     Task   `json:"task"`
+		Nonce    string `json:"nonce"`
+		IssuedAt int64  `json:"issued_at"`
+	}{e.Task, e.Nonce, e.IssuedAt})
+}
+
+// nonceMaxAge bounds both how long a signed envelope is considered fresh and
+// how long its nonce is remembered to reject replays.
+const nonceMaxAge = 5 * time.Minute
+
 var (
-	natsURL    = flag.String("url", "nats://192.168.1.10:4222", "NATS server URL")
-	macAddress = flag.String("mac", "", "MAC address of this client")
-	logFile    = flag.String("log", "/tmp/pxe-agent.log", "Log file path")
-	pxeServer  = flag.String("server", "http://192.168.1.10:3000", "PXE server URL")
-	tlsCA      = flag.String("tls-ca", "", "Path to CA certificate for NATS TLS")
-	tlsCert    = flag.String("tls-cert", "", "Path to client certificate for NATS TLS")
-	tlsKey     = flag.String("tls-key", "", "Path to client key for NATS TLS")
+	natsURL       = flag.String("url", "nats://192.168.1.10:4222", "NATS server URL")
+	macAddress    = flag.String("mac", "", "MAC address of this client")
+	logFile       = flag.String("log", "/tmp/pxe-agent.log", "Log file path")
+	tlsCA         = flag.String("tls-ca", "", "Path to CA certificate for NATS TLS")
+	tlsCert       = flag.String("tls-cert", "", "Path to client certificate for NATS TLS")
+	tlsKey        = flag.String("tls-key", "", "Path to client key for NATS TLS")
+	serverNkey    = flag.String("server-nkey", "", "Path to the PXE server's public NKey, used to verify signed task envelopes (required)")
+	providersFlag = flag.String("providers", "reboot,shutdown,install", "Comma-separated list of task providers to enable on this host")
+	heartbeat     = flag.Duration("heartbeat", 30*time.Second, "Interval between inventory/heartbeat publishes")
+	factsScript   = flag.String("facts-script", "", "Optional path to a script; its stdout JSON is merged into the inventory payload")
+	maxConcurrent = flag.Int("max-concurrent", 4, "Maximum number of tasks this agent executes at once, across all types")
+	maxPerType    = flag.Int("max-concurrent-per-type", 2, "Maximum number of tasks of a single type this agent executes at once")
+	fetchBatch    = flag.Int("fetch-batch", 4, "Number of task messages to pull per JetStream fetch")
+
+	seenNonces   = make(map[string]time.Time)
+	seenNoncesMu sync.Mutex
 )
 
+// nonceSeen reports whether nonce has already been used and, as a side
+// effect, records it and prunes entries older than nonceMaxAge.
+func nonceSeen(nonce string) bool {
+	seenNoncesMu.Lock()
+	defer seenNoncesMu.Unlock()
+
+	now := time.Now()
+	for n, seenAt := range seenNonces {
+		if now.Sub(seenAt) > nonceMaxAge {
+			delete(seenNonces, n)
+		}
+	}
+
+	if _, ok := seenNonces[nonce]; ok {
+		return true
+	}
+	seenNonces[nonce] = now
+	return false
+}
+
+// touchNonce records nonce as seen (or refreshes it) without treating a
+// prior sighting as a replay. Used for JetStream redeliveries, which carry
+// the same nonce as the delivery that already recorded it via nonceSeen.
+func touchNonce(nonce string) {
+	seenNoncesMu.Lock()
+	defer seenNoncesMu.Unlock()
+	seenNonces[nonce] = time.Now()
+}
+
+// verifyEnvelope unmarshals data as a signed Envelope, checks that IssuedAt
+// is within nonceMaxAge, that Signature is a valid NKey signature over the
+// envelope's signed payload, and - unless redelivered is set - that Nonce
+// hasn't been seen before. redelivered must be true when JetStream is
+// redelivering a message already seen on an earlier delivery attempt (e.g.
+// after a Nak): it carries the exact same nonce as that first delivery, so
+// checking it against seenNonces would always and incorrectly flag it as a
+// replay. On success it returns the embedded Task.
+func verifyEnvelope(serverKey nkeys.KeyPair, data []byte, redelivered bool) (*Task, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+
+	if age := time.Since(time.Unix(env.IssuedAt, 0)); age > nonceMaxAge || age < -nonceMaxAge {
+		return nil, fmt.Errorf("envelope issued_at outside of acceptable window (%v old)", age)
+	}
+	if redelivered {
+		touchNonce(env.Nonce)
+	} else if nonceSeen(env.Nonce) {
+		return nil, fmt.Errorf("nonce %q already used (possible replay)", env.Nonce)
+	}
+
+	payload, err := env.signedPayload()
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconstruct signed payload: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if err := serverKey.Verify(payload, sig); err != nil {
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	return &env.Task, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -39,6 +144,18 @@ func main() {
 		log.Fatal("MAC address is required (-mac flag)")
 	}
 
+	if *serverNkey == "" {
+		log.Fatal("PXE server NKey is required (-server-nkey flag); agents no longer execute unsigned tasks")
+	}
+	serverNkeyData, err := os.ReadFile(*serverNkey)
+	if err != nil {
+		log.Fatal("Failed to read -server-nkey:", err)
+	}
+	serverKeyPair, err := nkeys.FromPublicKey(strings.TrimSpace(string(serverNkeyData)))
+	if err != nil {
+		log.Fatal("Failed to parse -server-nkey as a public NKey:", err)
+	}
+
 	// Open log file
 	logFileHandle, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -88,6 +205,16 @@ func main() {
 		log.Fatal("Failed to create JetStream context:", err)
 	}
 
+	// Bind (or lazily create) the KV bucket completion results fall back to
+	// when no one is listening on the completion subject.
+	resultsKV, err := js.KeyValue("PXE_TASK_RESULTS")
+	if err != nil {
+		resultsKV, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "PXE_TASK_RESULTS"})
+		if err != nil {
+			log.Fatal("Failed to bind PXE_TASK_RESULTS KV bucket:", err)
+		}
+	}
+
 	// Subscribe to tasks for this MAC address
 	subject := fmt.Sprintf("pxe.tasks.%s", *macAddress)
 	consumerName := fmt.Sprintf("pxe-agent-%s", *macAddress)
@@ -119,94 +246,331 @@ func main() {
 
 	log.Printf("Subscribed successfully, waiting for tasks...")
 
-	// Handle graceful shutdown
+	env := &ProviderEnv{NC: nc, ResultsKV: resultsKV, MacAddress: *macAddress}
+	providers := buildProviders(env, *providersFlag)
+	log.Printf("Enabled task providers: %s", *providersFlag)
+
+	// Handle graceful shutdown: cancelling ctx lets in-flight tasks (e.g. a
+	// running install) finish or be interrupted cleanly instead of killing
+	// them outright.
+	ctx, cancel := context.WithCancel(context.Background())
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Process messages in a goroutine
 	go func() {
-		for {
-			msgs, err := sub.Fetch(1, nats.MaxWait(5*time.Second))
-			if err != nil {
-				if err == nats.ErrTimeout {
-					continue
-				}
-				log.Printf("Error fetching messages: %v", err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-
-			for _, msg := range msgs {
-				var task Task
-				if err := json.Unmarshal(msg.Data, &task); err != nil {
-					log.Printf("Failed to parse task: %v", err)
-					msg.Ack()
-					continue
-				}
-
-				log.Printf("Received task: ID=%d, Type=%s", task.ID, task.Type)
-
-				// Execute task
-				if executeTask(&task, *macAddress, *pxeServer) {
-					msg.Ack()
-					log.Printf("Task %d completed successfully", task.ID)
-				} else {
-					log.Printf("Task %d failed, will retry", task.ID)
-					// Don't ack, let NATS retry
-				}
-			}
-		}
+		<-sigChan
+		log.Printf("Shutdown signal received, waiting for in-flight tasks...")
+		cancel()
 	}()
 
-	// Wait for shutdown signal
-	<-sigChan
+	flushPendingResults(env)
+	replayCachedTasks(ctx, providers, env)
+
+	go runHeartbeat(nc, *macAddress, *factsScript, *heartbeat)
+
+	sem := newTaskSemaphores(*maxConcurrent, *maxPerType)
+	runTaskLoop(ctx, sub, serverKeyPair, providers, env, sem, *fetchBatch)
+
 	log.Printf("Shutting down...")
 }
 
-func executeTask(task *Task, macAddress, pxeServer string) bool {
+// Result is what a TaskProvider reports back after running a Task.
+type Result struct {
+	Success bool
+	Message string
+}
+
+// TaskProvider handles execution of a single task type. New task types are
+// added by implementing this interface and registering them in
+// buildProviders, without touching the dispatch loop in main.
+type TaskProvider interface {
+	Type() string
+	Execute(ctx context.Context, task *Task) (Result, error)
+}
+
+// ProviderEnv carries the dependencies providers need to do their job: the
+// NATS connection for log streaming and completion reporting, the
+// PXE_TASK_RESULTS KV bucket results fall back to, and this agent's MAC.
+type ProviderEnv struct {
+	NC         *nats.Conn
+	ResultsKV  nats.KeyValue
+	MacAddress string
+}
+
+// logLine writes a log line locally and streams it to pxe.tasks.<mac>.log
+// so the PXE server can tail task output in real time.
+func (e *ProviderEnv) logLine(taskID int, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	log.Printf("[task %d] %s", taskID, line)
+	subject := fmt.Sprintf("pxe.tasks.%s.log", e.MacAddress)
+	e.NC.Publish(subject, []byte(fmt.Sprintf("[task %d] %s", taskID, line)))
+}
+
+// logWriter is an io.Writer that splits whatever is written to it into
+// lines and streams each one via ProviderEnv.logLine.
+type logWriter struct {
+	env    *ProviderEnv
+	taskID int
+	buf    bytes.Buffer
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.env.logLine(w.taskID, "%s", strings.TrimRight(line, "\n"))
+	}
+	return len(p), nil
+}
+
+// runStreaming runs name with args, streaming combined stdout/stderr to
+// pxe.tasks.<mac>.log line by line, and honors ctx cancellation.
+func (e *ProviderEnv) runStreaming(ctx context.Context, task *Task, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	w := &logWriter{env: e, taskID: task.ID}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return cmd.Run()
+}
+
+// RebootProvider reboots the host after reporting task completion, since
+// there's no agent left to report from once the reboot actually happens.
+type RebootProvider struct{ env *ProviderEnv }
+
+func (p *RebootProvider) Type() string { return "reboot" }
+
+func (p *RebootProvider) Execute(ctx context.Context, task *Task) (Result, error) {
+	reportTaskCompletionAsync(p.env, task.ID, true, "Reboot command executed")
+	p.env.logLine(task.ID, "Rebooting in 2 seconds...")
+	time.Sleep(2 * time.Second)
+	if err := p.env.runStreaming(ctx, task, "sync"); err != nil {
+		p.env.logLine(task.ID, "sync failed: %v", err)
+	}
+	if err := p.env.runStreaming(ctx, task, "reboot", "-f"); err != nil {
+		return Result{}, fmt.Errorf("reboot failed: %w", err)
+	}
+	return Result{Success: true, Message: "Reboot command executed"}, nil
+}
+
+// ShutdownProvider powers off the host after reporting task completion.
+type ShutdownProvider struct{ env *ProviderEnv }
+
+func (p *ShutdownProvider) Type() string { return "shutdown" }
+
+func (p *ShutdownProvider) Execute(ctx context.Context, task *Task) (Result, error) {
+	reportTaskCompletionAsync(p.env, task.ID, true, "Shutdown command executed")
+	p.env.logLine(task.ID, "Shutting down in 2 seconds...")
+	time.Sleep(2 * time.Second)
+	if err := p.env.runStreaming(ctx, task, "sync"); err != nil {
+		p.env.logLine(task.ID, "sync failed: %v", err)
+	}
+	if err := p.env.runStreaming(ctx, task, "poweroff", "-f"); err != nil {
+		return Result{}, fmt.Errorf("shutdown failed: %w", err)
+	}
+	return Result{Success: true, Message: "Shutdown command executed"}, nil
+}
+
+// InstallProvider exists only to acknowledge install tasks; the actual
+// install is driven by the installer, not the agent.
+type InstallProvider struct{ env *ProviderEnv }
+
+func (p *InstallProvider) Type() string { return "install" }
+
+func (p *InstallProvider) Execute(ctx context.Context, task *Task) (Result, error) {
+	p.env.logLine(task.ID, "Install task received - should be handled by installer")
+	reportTaskCompletion(p.env, task.ID, false, "Install tasks should be handled by installer")
+	return Result{Success: false, Message: "Install tasks should be handled by installer"}, nil
+}
+
+// builtinProviders returns every TaskProvider this agent ships with.
+func builtinProviders(env *ProviderEnv) []TaskProvider {
+	return []TaskProvider{
+		&RebootProvider{env: env},
+		&ShutdownProvider{env: env},
+		&InstallProvider{env: env},
+	}
+}
+
+// buildProviders registers the providers named in the comma-separated
+// enabled list (as passed via -providers) into a map keyed by Type().
+func buildProviders(env *ProviderEnv, enabled string) map[string]TaskProvider {
+	allow := make(map[string]bool)
+	for _, name := range strings.Split(enabled, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allow[name] = true
+		}
+	}
+
+	providers := make(map[string]TaskProvider)
+	for _, p := range builtinProviders(env) {
+		if allow[p.Type()] {
+			providers[p.Type()] = p
+		}
+	}
+	return providers
+}
+
+func executeTask(ctx context.Context, providers map[string]TaskProvider, env *ProviderEnv, task *Task) bool {
 	log.Printf("Executing task %d: type=%s", task.ID, task.Type)
 
-	switch task.Type {
-	case "reboot":
-		// Report success before rebooting
-		reportTaskCompletion(pxeServer, macAddress, task.ID, true, "Reboot command executed")
-		log.Printf("Rebooting in 2 seconds...")
-		time.Sleep(2 * time.Second)
-		sync()
-		exec.Command("reboot", "-f").Run()
+	provider, ok := providers[task.Type]
+	if !ok {
+		log.Printf("Unknown or disabled task type: %s", task.Type)
+		reportTaskCompletion(env, task.ID, false, fmt.Sprintf("Unknown or disabled task type: %s", task.Type))
 		return true
+	}
 
-	case "shutdown":
-		// Report success before shutting down
-		reportTaskCompletion(pxeServer, macAddress, task.ID, true, "Shutdown command executed")
-		log.Printf("Shutting down in 2 seconds...")
-		time.Sleep(2 * time.Second)
-		sync()
-		exec.Command("poweroff", "-f").Run()
-		return true
+	result, err := provider.Execute(ctx, task)
+	if err != nil {
+		log.Printf("Task %d failed: %v", task.ID, err)
+		return false
+	}
+	log.Printf("Task %d result: success=%v message=%q", task.ID, result.Success, result.Message)
+	return true
+}
 
-	case "install":
-		log.Printf("Install task received - should be handled by installer")
-		reportTaskCompletion(pxeServer, macAddress, task.ID, false, "Install tasks should be handled by installer")
-		return true
+// TaskResult is the completion payload published, stored in the
+// PXE_TASK_RESULTS KV bucket, and persisted under pendingResultsDir.
+type TaskResult struct {
+	TaskID      int    `json:"task_id"`
+	MacAddress  string `json:"mac_address"`
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	CompletedAt int64  `json:"completed_at"`
+}
 
-	default:
-		log.Printf("Unknown task type: %s", task.Type)
-		reportTaskCompletion(pxeServer, macAddress, task.ID, false, fmt.Sprintf("Unknown task type: %s", task.Type))
-		return true
+// completionRequestTimeout is deliberately short: the request/reply path is
+// a best-effort fast path for a server that happens to answer it directly,
+// not the primary delivery mechanism. This request's own deployment model
+// lets the server instead watch the PXE_TASK_RESULTS KV bucket or subscribe
+// to the completion subject, in which case nothing ever replies - so a long
+// timeout (or retries) would only make every completion, and anything
+// blocking on it (e.g. a reboot), wait that much longer for no reason.
+const (
+	completionRequestTimeout = 500 * time.Millisecond
+	pendingResultsDir        = "/var/lib/pxe-agent/pending"
+)
+
+func completeSubject(macAddress string, taskID int) string {
+	return fmt.Sprintf("pxe.tasks.%s.complete.%d", macAddress, taskID)
+}
+
+func pendingResultPath(taskID int) string {
+	return filepath.Join(pendingResultsDir, fmt.Sprintf("%d.json", taskID))
+}
+
+// reportTaskCompletion tells the PXE server a task is done. It tries a
+// single short NATS request/reply in case the server happens to answer it
+// directly; the PXE_TASK_RESULTS KV bucket, not a retried request, is the
+// primary durable path, since a server that watches the KV or subscribes to
+// the completion subject instead of replying is an explicitly supported
+// deployment model and would otherwise never be reached any faster than the
+// request could time out. If the KV write also fails (e.g. JetStream is
+// unreachable), the result is persisted to pendingResultsDir and retried by
+// flushPendingResults on next startup.
+func reportTaskCompletion(env *ProviderEnv, taskID int, success bool, message string) {
+	result := TaskResult{
+		TaskID:      taskID,
+		MacAddress:  env.MacAddress,
+		Success:     success,
+		Message:     message,
+		CompletedAt: time.Now().Unix(),
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to marshal completion for task %d: %v", taskID, err)
+		return
+	}
+
+	subject := completeSubject(env.MacAddress, taskID)
+	if _, err := env.NC.Request(subject, data, completionRequestTimeout); err == nil {
+		return
+	}
+
+	if env.ResultsKV != nil {
+		if _, err := env.ResultsKV.Put(kvResultKey(env.MacAddress, taskID), data); err == nil {
+			log.Printf("Task %d completion persisted to PXE_TASK_RESULTS", taskID)
+			return
+		} else {
+			log.Printf("Failed to persist task %d completion to KV: %v", taskID, err)
+		}
+	}
+
+	if err := os.MkdirAll(pendingResultsDir, 0755); err != nil {
+		log.Printf("Failed to create pending results dir: %v", err)
+		return
+	}
+	if err := os.WriteFile(pendingResultPath(taskID), data, 0644); err != nil {
+		log.Printf("Failed to persist task %d completion to disk: %v", taskID, err)
 	}
 }
 
-func reportTaskCompletion(pxeServer, macAddress string, taskID int, success bool, result string) {
-	url := fmt.Sprintf("%s/api/servers/%s/tasks/%d/complete", pxeServer, macAddress, taskID)
-	payload := fmt.Sprintf(`{"success":%t,"result":"%s"}`, success, result)
+// kvResultKey derives a PXE_TASK_RESULTS key from a MAC address and task
+// ID. NATS KV keys only allow `[-/_=.a-zA-Z0-9]`, so the colons in a MAC
+// address (e.g. aa:bb:cc:dd:ee:ff) are replaced before use.
+func kvResultKey(macAddress string, taskID int) string {
+	return fmt.Sprintf("%s.%d", strings.ReplaceAll(macAddress, ":", "-"), taskID)
+}
 
-	cmd := exec.Command("curl", "-s", "-X", "POST", url,
-		"-H", "Content-Type: application/json",
-		"-d", payload)
-	cmd.Run() // Ignore errors, we're about to reboot/shutdown anyway
+// reportTaskCompletionAsync fires reportTaskCompletion in the background.
+// RebootProvider and ShutdownProvider use this instead of calling it
+// directly so the request/KV/disk cascade never adds latency to an
+// imminent reboot, however small.
+func reportTaskCompletionAsync(env *ProviderEnv, taskID int, success bool, message string) {
+	go reportTaskCompletion(env, taskID, success, message)
 }
 
-func sync() {
-	exec.Command("sync").Run()
+// flushPendingResults redelivers completions left under pendingResultsDir
+// by a previous run that rebooted/shut down before the result made it to
+// the server, e.g. after a reboot task's own reportTaskCompletion couldn't
+// reach anything. Delivered results are removed from disk.
+func flushPendingResults(env *ProviderEnv) {
+	entries, err := os.ReadDir(pendingResultsDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read pending results dir: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(pendingResultsDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read pending result %s: %v", path, err)
+			continue
+		}
+
+		var result TaskResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			log.Printf("Failed to parse pending result %s: %v", path, err)
+			continue
+		}
+
+		delivered := false
+		if _, err := env.NC.Request(completeSubject(result.MacAddress, result.TaskID), data, completionRequestTimeout); err == nil {
+			delivered = true
+		} else if env.ResultsKV != nil {
+			if _, err := env.ResultsKV.Put(kvResultKey(result.MacAddress, result.TaskID), data); err == nil {
+				delivered = true
+			}
+		}
+
+		if !delivered {
+			log.Printf("Still unable to deliver pending completion for task %d, will retry next startup", result.TaskID)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove delivered pending result %s: %v", path, err)
+		} else {
+			log.Printf("Replayed pending completion for task %d", result.TaskID)
+		}
+	}
 }
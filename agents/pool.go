@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// inProgressInterval is how often a running task pings msg.InProgress()
+	// so JetStream doesn't redeliver it out from under a legitimately long
+	// task.
+	inProgressInterval = 10 * time.Second
+
+	// fetchMaxWait bounds how long a single sub.Fetch call blocks for more
+	// messages before the loop re-checks ctx for cancellation.
+	fetchMaxWait = 2 * time.Second
+)
+
+// taskSemaphores bounds how many tasks run at once, both across the whole
+// agent (global) and per task type. A task must acquire both before it's
+// allowed to run.
+type taskSemaphores struct {
+	global chan struct{}
+
+	mu      sync.Mutex
+	byType  map[string]chan struct{}
+	perType int
+}
+
+func newTaskSemaphores(maxConcurrent, perType int) *taskSemaphores {
+	return &taskSemaphores{
+		global:  make(chan struct{}, maxConcurrent),
+		byType:  make(map[string]chan struct{}),
+		perType: perType,
+	}
+}
+
+func (s *taskSemaphores) typeChan(taskType string) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.byType[taskType]
+	if !ok {
+		ch = make(chan struct{}, s.perType)
+		s.byType[taskType] = ch
+	}
+	return ch
+}
+
+func (s *taskSemaphores) acquire(taskType string) {
+	s.global <- struct{}{}
+	s.typeChan(taskType) <- struct{}{}
+}
+
+func (s *taskSemaphores) release(taskType string) {
+	<-s.typeChan(taskType)
+	<-s.global
+}
+
+// runTaskLoop pulls batches of task messages and dispatches each to its own
+// goroutine, bounded by sem, until ctx is cancelled. It then waits for all
+// in-flight tasks to return before returning itself, so main can shut down
+// cleanly.
+func runTaskLoop(ctx context.Context, sub *nats.Subscription, serverKey nkeys.KeyPair, providers map[string]TaskProvider, env *ProviderEnv, sem *taskSemaphores, fetchBatch int) {
+	var wg sync.WaitGroup
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		default:
+		}
+
+		msgs, err := sub.Fetch(fetchBatch, nats.MaxWait(fetchMaxWait))
+		if err != nil {
+			if err == nats.ErrTimeout {
+				continue
+			}
+			log.Printf("Error fetching messages: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, msg := range msgs {
+			redelivered := false
+			if meta, err := msg.Metadata(); err == nil {
+				redelivered = meta.NumDelivered > 1
+			}
+
+			task, err := verifyEnvelope(serverKey, msg.Data, redelivered)
+			if err != nil {
+				log.Printf("Rejecting tampered/unsigned task: %v", err)
+				msg.Term()
+				continue
+			}
+
+			wg.Add(1)
+			go func(msg *nats.Msg, task *Task) {
+				defer wg.Done()
+				dispatchTask(ctx, sem, providers, env, msg, task)
+			}(msg, task)
+		}
+	}
+}
+
+// dispatchTask runs a single task under sem's concurrency limits, keeping
+// JetStream's redelivery timer at bay while it's in flight, and acks or
+// naks the message depending on the outcome.
+func dispatchTask(ctx context.Context, sem *taskSemaphores, providers map[string]TaskProvider, env *ProviderEnv, msg *nats.Msg, task *Task) {
+	sem.acquire(task.Type)
+	defer sem.release(task.Type)
+
+	stopKeepAlive := keepInProgress(msg)
+	defer stopKeepAlive()
+
+	log.Printf("Received task: ID=%d, Type=%s", task.ID, task.Type)
+	cacheTask(env, task, TaskStateReceived)
+
+	if restartsHost(task.Type) {
+		// A successful Execute reboots/powers off the host and never returns,
+		// so there's no "after" left to Ack from - the process is gone. Ack
+		// now instead, so JetStream doesn't redeliver (and re-run) this same
+		// reboot up to MaxDeliver times; replayCachedTasks reconciles
+		// completion with the server once the agent comes back up.
+		msg.Ack()
+		stopKeepAlive()
+		cacheTask(env, task, TaskStateExecuting)
+		ok := executeTask(ctx, providers, env, task)
+		// Getting here means the host did not restart, so the entry must not
+		// stay in "executing" for replayCachedTasks to reconcile as completed.
+		if ok {
+			cacheTask(env, task, TaskStateCompleted)
+		} else {
+			cacheTask(env, task, TaskStateFailed)
+		}
+		clearCachedTask(task.ID)
+		return
+	}
+
+	cacheTask(env, task, TaskStateExecuting)
+	if executeTask(ctx, providers, env, task) {
+		cacheTask(env, task, TaskStateCompleted)
+		clearCachedTask(task.ID)
+		msg.Ack()
+		log.Printf("Task %d completed successfully", task.ID)
+		return
+	}
+
+	cacheTask(env, task, TaskStateFailed)
+	clearCachedTask(task.ID)
+	if ctx.Err() != nil {
+		log.Printf("Task %d interrupted by shutdown, NACKing for redelivery", task.ID)
+	} else {
+		log.Printf("Task %d failed, will retry", task.ID)
+	}
+	msg.Nak()
+}
+
+// keepInProgress pings msg.InProgress() on a ticker until the returned
+// stop func is called, preventing JetStream from redelivering a task
+// that's still legitimately running. The returned stop func is safe to
+// call more than once.
+func keepInProgress(msg *nats.Msg) func() {
+	ticker := time.NewTicker(inProgressInterval)
+	done := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					log.Printf("Failed to send in-progress keep-alive: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
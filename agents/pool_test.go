@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// startEmbeddedServer boots a JetStream-enabled NATS server in-process, per
+// the embedded nats-server/v2/server pattern, so pool behavior is
+// verifiable without a real broker.
+func startEmbeddedServer(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create embedded NATS server: %v", err)
+	}
+
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("embedded NATS server did not become ready")
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to embedded NATS server: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+// signEnvelope builds and signs an Envelope the way the PXE server would.
+func signEnvelope(t *testing.T, kp nkeys.KeyPair, task Task, nonce string) []byte {
+	t.Helper()
+
+	env := Envelope{Task: task, Nonce: nonce, IssuedAt: time.Now().Unix()}
+	payload, err := env.signedPayload()
+	if err != nil {
+		t.Fatalf("failed to build signed payload: %v", err)
+	}
+	sig, err := kp.Sign(payload)
+	if err != nil {
+		t.Fatalf("failed to sign payload: %v", err)
+	}
+	env.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatalf("failed to marshal envelope: %v", err)
+	}
+	return data
+}
+
+// sleepyProvider is a test-only TaskProvider that sleeps for delay and
+// records how many instances of itself were running concurrently.
+type sleepyProvider struct {
+	delay time.Duration
+
+	mu        sync.Mutex
+	current   int
+	maxSeen   int
+	completed int
+}
+
+func (p *sleepyProvider) Type() string { return "sleepy" }
+
+func (p *sleepyProvider) Execute(ctx context.Context, task *Task) (Result, error) {
+	p.mu.Lock()
+	p.current++
+	if p.current > p.maxSeen {
+		p.maxSeen = p.current
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	p.current--
+	p.completed++
+	p.mu.Unlock()
+
+	return Result{Success: true, Message: "slept"}, nil
+}
+
+func TestTaskSemaphoresBoundsConcurrency(t *testing.T) {
+	sem := newTaskSemaphores(3, 2)
+
+	var mu sync.Mutex
+	current, maxSeen := 0, 0
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire("reboot")
+			defer sem.release("reboot")
+
+			mu.Lock()
+			current++
+			if current > maxSeen {
+				maxSeen = current
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			current--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxSeen > 2 {
+		t.Errorf("saw %d concurrent reboot tasks, want at most 2 (per-type limit)", maxSeen)
+	}
+}
+
+func TestRunTaskLoopRespectsConcurrencyLimits(t *testing.T) {
+	nc := startEmbeddedServer(t)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("failed to create JetStream context: %v", err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "PXE_TASKS", Subjects: []string{"pxe.tasks.*"}}); err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+	if _, err := js.AddConsumer("PXE_TASKS", &nats.ConsumerConfig{
+		Durable:       "test-agent",
+		FilterSubject: "pxe.tasks.test-mac",
+		AckPolicy:     nats.AckExplicitPolicy,
+		MaxDeliver:    3,
+	}); err != nil {
+		t.Fatalf("failed to create consumer: %v", err)
+	}
+	sub, err := js.PullSubscribe("pxe.tasks.test-mac", "test-agent", nats.Bind("PXE_TASKS", "test-agent"))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	serverKP, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatalf("failed to create server nkey: %v", err)
+	}
+	pub, err := serverKP.PublicKey()
+	if err != nil {
+		t.Fatalf("failed to get public key: %v", err)
+	}
+	verifyKP, err := nkeys.FromPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to load public key: %v", err)
+	}
+
+	const taskCount = 6
+	const perType = 2
+	provider := &sleepyProvider{delay: 200 * time.Millisecond}
+	providers := map[string]TaskProvider{"sleepy": provider}
+	env := &ProviderEnv{NC: nc, MacAddress: "test-mac"}
+
+	for i := 0; i < taskCount; i++ {
+		data := signEnvelope(t, serverKP, Task{ID: i, Type: "sleepy"}, fmt.Sprintf("nonce-%d", i))
+		if _, err := js.Publish("pxe.tasks.test-mac", data); err != nil {
+			t.Fatalf("failed to publish task %d: %v", i, err)
+		}
+	}
+
+	sem := newTaskSemaphores(4, perType)
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		runTaskLoop(ctx, sub, verifyKP, providers, env, sem, 4)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(8 * time.Second):
+		t.Fatal("runTaskLoop did not return after context was cancelled")
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.maxSeen > perType {
+		t.Errorf("saw %d concurrent sleepy tasks, want at most %d", provider.maxSeen, perType)
+	}
+	if provider.completed != taskCount {
+		t.Errorf("completed %d tasks, want %d", provider.completed, taskCount)
+	}
+}